@@ -0,0 +1,327 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cancelMethod is the well-known notification used to cancel an in-flight
+// request on the peer that is handling it, mirroring the LSP convention.
+const cancelMethod = "$/cancelRequest"
+
+// cancelNotifyTimeout is the deadline of the context given to the
+// best-effort $/cancelRequest notification that Call sends from a separate
+// goroutine once ctx is done. Call itself returns without waiting for that
+// notification, so a wedged Stream can't keep Call blocked past its
+// caller's own cancellation.
+const cancelNotifyTimeout = 5 * time.Second
+
+type cancelParams struct {
+	Id *json.RawMessage `json:"id"`
+}
+
+// Stream abstracts the framing of a bidirectional byte stream so that Conn
+// can run over a WebSocket, a Unix socket, or LSP-style Content-Length
+// framed stdio without knowing the details of any of them.
+type Stream interface {
+	// Read returns the next complete, framed message.
+	Read(ctx context.Context) ([]byte, error)
+
+	// Write sends a complete, already-framed message.
+	Write(ctx context.Context, data []byte) error
+}
+
+// Handler processes inbound requests and notifications received on a Conn.
+// For notifications the returned result/err are discarded.
+type Handler interface {
+	Handle(ctx context.Context, conn *Conn, method string, params *json.RawMessage) (result interface{}, err error)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(ctx context.Context, conn *Conn, method string, params *json.RawMessage) (interface{}, error)
+
+func (f HandlerFunc) Handle(ctx context.Context, conn *Conn, method string, params *json.RawMessage) (interface{}, error) {
+	return f(ctx, conn, method, params)
+}
+
+// connResponse mirrors serverResponse but keeps Result as a RawMessage so a
+// received response can be unmarshaled into the caller's reply type; it is
+// wire-compatible with serverResponse.
+type connResponse struct {
+	Version string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+	Id      *json.RawMessage `json:"id"`
+}
+
+// Conn is a symmetric, bidirectional JSON-RPC 2.0 connection: either peer
+// may call the other, and both may be handling requests from the other at
+// the same time. Unlike Codec/CodecRequest, which model a single HTTP
+// request/response, a Conn owns a long-lived Stream and keeps dispatching
+// messages until Run returns.
+type Conn struct {
+	stream  Stream
+	handler Handler
+
+	seq int64
+
+	mu       sync.Mutex
+	pending  map[string]chan *connResponse
+	handling map[string]context.CancelFunc
+
+	// writeMu serializes every Stream.Write call. Most framed-stream
+	// implementations (e.g. gorilla/websocket's Conn) aren't safe for
+	// concurrent writers, and Call, Notify and handle can all write at once.
+	writeMu sync.Mutex
+}
+
+// NewConn creates a Conn that reads and writes messages over stream,
+// dispatching inbound requests and notifications to handler. handler may be
+// nil for a Conn that only ever calls out and never serves requests; any
+// inbound request it still receives is answered with E_NO_METHOD, and any
+// inbound notification is silently dropped.
+func NewConn(stream Stream, handler Handler) *Conn {
+	return &Conn{
+		stream:   stream,
+		handler:  handler,
+		pending:  make(map[string]chan *connResponse),
+		handling: make(map[string]context.CancelFunc),
+	}
+}
+
+// Run reads messages off the Stream until it returns an error (including
+// ctx.Err() once ctx is done), dispatching each to the pending Call it
+// answers or to the Handler when it is an inbound request or notification.
+func (c *Conn) Run(ctx context.Context) error {
+	for {
+		data, err := c.stream.Read(ctx)
+		if err != nil {
+			return err
+		}
+		c.dispatch(ctx, data)
+	}
+}
+
+// Call sends method with params as a request and blocks until the peer
+// replies or ctx is done. If reply is non-nil, the
+// result is unmarshaled into it. If ctx is done before a reply arrives, a
+// $/cancelRequest notification is sent for this call's id.
+func (c *Conn) Call(ctx context.Context, method string, params interface{}, reply interface{}) error {
+	id := json.RawMessage(strconv.FormatInt(atomic.AddInt64(&c.seq, 1), 10))
+
+	paramsRaw, err := marshalParams(params)
+	if err != nil {
+		return fmt.Errorf("marshaling params: %w", err)
+	}
+
+	req := &serverRequest{
+		Version: Version,
+		Method:  method,
+		Params:  paramsRaw,
+		Id:      &id,
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshaling request: %w", err)
+	}
+
+	respCh := make(chan *connResponse, 1)
+	key := string(id)
+	c.mu.Lock()
+	c.pending[key] = respCh
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, key)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(ctx, data); err != nil {
+		return fmt.Errorf("writing request: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		// Best-effort: tell the peer to stop working on this call, but don't
+		// let a wedged Stream keep Call blocked past ctx being done.
+		go func() {
+			cancelCtx, cancel := context.WithTimeout(context.Background(), cancelNotifyTimeout)
+			defer cancel()
+			c.Notify(cancelCtx, cancelMethod, cancelParams{Id: &id})
+		}()
+		return ctx.Err()
+	case resp := <-respCh:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if reply != nil && resp.Result != nil {
+			if err := json.Unmarshal(*resp.Result, reply); err != nil {
+				return fmt.Errorf("unmarshaling result: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+// Notify sends method with params as a notification; it does not wait for,
+// or expect, a reply.
+func (c *Conn) Notify(ctx context.Context, method string, params interface{}) error {
+	paramsRaw, err := marshalParams(params)
+	if err != nil {
+		return fmt.Errorf("marshaling params: %w", err)
+	}
+
+	data, err := json.Marshal(&serverRequest{
+		Version: Version,
+		Method:  method,
+		Params:  paramsRaw,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling notification: %w", err)
+	}
+
+	return c.write(ctx, data)
+}
+
+// write serializes access to stream.Write across Call, Notify and handle.
+func (c *Conn) write(ctx context.Context, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.stream.Write(ctx, data)
+}
+
+// dispatch routes a single decoded message: a reply to one of our own
+// Call invocations, a $/cancelRequest notification, or an inbound
+// request/notification for the Handler.
+func (c *Conn) dispatch(ctx context.Context, data []byte) {
+	var envelope struct {
+		Method *string          `json:"method"`
+		Params *json.RawMessage `json:"params"`
+		Id     *json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return
+	}
+
+	if envelope.Method == nil {
+		c.completePending(envelope.Id, data)
+		return
+	}
+
+	if *envelope.Method == cancelMethod {
+		var p cancelParams
+		if envelope.Params != nil {
+			json.Unmarshal(*envelope.Params, &p)
+		}
+		c.cancelHandling(p.Id)
+		return
+	}
+
+	go c.handle(ctx, envelope.Id, *envelope.Method, envelope.Params)
+}
+
+func (c *Conn) completePending(id *json.RawMessage, data []byte) {
+	if id == nil {
+		return
+	}
+
+	key := string(*id)
+	c.mu.Lock()
+	ch, ok := c.pending[key]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	var resp connResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return
+	}
+	ch <- &resp
+}
+
+func (c *Conn) cancelHandling(id *json.RawMessage) {
+	if id == nil {
+		return
+	}
+
+	key := string(*id)
+	c.mu.Lock()
+	cancel, ok := c.handling[key]
+	c.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (c *Conn) handle(ctx context.Context, id *json.RawMessage, method string, params *json.RawMessage) {
+	hctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if id != nil {
+		key := string(*id)
+		c.mu.Lock()
+		c.handling[key] = cancel
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.handling, key)
+			c.mu.Unlock()
+		}()
+	}
+
+	var result interface{}
+	var err error
+	if c.handler == nil {
+		// A Conn is allowed to omit its Handler when it only ever calls out
+		// (see NewConn), but the peer is free to send it a real request
+		// anyway; report that instead of dereferencing a nil Handler.
+		err = NewMethodNotFound(method)
+	} else {
+		result, err = c.handler.Handle(hctx, c, method, params)
+	}
+	if id == nil {
+		// Notification: no response expected.
+		return
+	}
+
+	res := &serverResponse{Version: Version, Id: id}
+	if err != nil {
+		jsonErr, ok := err.(*Error)
+		if !ok {
+			jsonErr = &Error{Code: E_INTERNAL, Message: err.Error()}
+		}
+		res.Error = jsonErr
+	} else {
+		res.Result = result
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		return
+	}
+	c.write(ctx, data)
+}
+
+func marshalParams(params interface{}) (*json.RawMessage, error) {
+	if params == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(data)
+	return &raw, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chanStream is a Stream backed by a pair of channels, used to wire two
+// Conns together without a real network transport.
+type chanStream struct {
+	out chan<- []byte
+	in  <-chan []byte
+}
+
+func (s *chanStream) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case data, ok := <-s.in:
+		if !ok {
+			return nil, io.EOF
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *chanStream) Write(ctx context.Context, data []byte) error {
+	select {
+	case s.out <- data:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newConnPair(serverHandler Handler) (client *Conn, server *Conn) {
+	ab := make(chan []byte, 16)
+	ba := make(chan []byte, 16)
+	client = NewConn(&chanStream{out: ab, in: ba}, nil)
+	server = NewConn(&chanStream{out: ba, in: ab}, serverHandler)
+	return client, server
+}
+
+func TestConnCallRoundTrip(t *testing.T) {
+	server := HandlerFunc(func(ctx context.Context, conn *Conn, method string, params *json.RawMessage) (interface{}, error) {
+		var args struct{ X int }
+		if params != nil {
+			json.Unmarshal(*params, &args)
+		}
+		return args.X * 2, nil
+	})
+
+	client, srv := newConnPair(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+	go srv.Run(ctx)
+
+	var reply int
+	if err := client.Call(context.Background(), "double", struct{ X int }{X: 21}, &reply); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if reply != 42 {
+		t.Fatalf("reply = %d, want 42", reply)
+	}
+}
+
+func TestConnCancelPropagatesToHandler(t *testing.T) {
+	handlerCancelled := make(chan struct{})
+
+	server := HandlerFunc(func(ctx context.Context, conn *Conn, method string, params *json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		close(handlerCancelled)
+		return nil, ctx.Err()
+	})
+
+	client, srv := newConnPair(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+	go srv.Run(ctx)
+
+	callCtx, cancelCall := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Call(callCtx, "slow", nil, nil)
+	}()
+
+	// Give the request time to reach the handler before cancelling.
+	time.Sleep(20 * time.Millisecond)
+	cancelCall()
+
+	select {
+	case <-handlerCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("$/cancelRequest was not propagated to the handler's context")
+	}
+
+	if err := <-done; err == nil {
+		t.Fatal("expected Call to return an error after its context was cancelled")
+	}
+}
+
+func TestConnNilHandlerRepliesMethodNotFoundInsteadOfPanicking(t *testing.T) {
+	client, srv := newConnPair(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+	go srv.Run(ctx)
+
+	err := client.Call(context.Background(), "whoami", nil, nil)
+	if err == nil {
+		t.Fatal("expected an error calling into a Conn with a nil Handler")
+	}
+	rpcErr, ok := err.(*Error)
+	if !ok || rpcErr.Code != E_NO_METHOD {
+		t.Fatalf("err = %v, want an *Error with code E_NO_METHOD", err)
+	}
+}
+
+// recordingStream detects overlapping Write calls so tests can verify Conn
+// serializes access to the Stream.
+type recordingStream struct {
+	active   int32
+	overlaps int32
+}
+
+func (s *recordingStream) Write(ctx context.Context, data []byte) error {
+	if atomic.AddInt32(&s.active, 1) > 1 {
+		atomic.AddInt32(&s.overlaps, 1)
+	}
+	time.Sleep(5 * time.Millisecond)
+	atomic.AddInt32(&s.active, -1)
+	return nil
+}
+
+func (s *recordingStream) Read(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestConnSerializesWrites(t *testing.T) {
+	stream := &recordingStream{}
+	conn := NewConn(stream, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := conn.Notify(context.Background(), "ping", i); err != nil {
+				t.Errorf("Notify: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&stream.overlaps); n != 0 {
+		t.Fatalf("expected Stream.Write calls to be serialized, observed %d overlapping writes", n)
+	}
+}
+
+// blockingCancelStream lets the first Write (the original request) succeed
+// immediately, then blocks every subsequent Write (standing in for a wedged
+// peer) so tests can verify Call doesn't wait on its own cancel notify.
+type blockingCancelStream struct {
+	calls int32
+}
+
+func (s *blockingCancelStream) Write(ctx context.Context, data []byte) error {
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		return nil
+	}
+	time.Sleep(2 * time.Second)
+	return nil
+}
+
+func (s *blockingCancelStream) Read(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestConnCallReturnsPromptlyOnCancelEvenIfNotifyBlocks(t *testing.T) {
+	conn := NewConn(&blockingCancelStream{}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := conn.Call(ctx, "slow", nil, nil)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected Call to return the context error")
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("Call blocked for %s waiting on its own cancel notification", elapsed)
+	}
+}
@@ -6,7 +6,9 @@
 package json2
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
 )
 
@@ -31,6 +33,43 @@ const (
 
 var ErrNullResult = errors.New("result is null")
 
+// reservedCodes are the codes predefined by the JSON-RPC 2.0 spec; they are
+// carved out of the reserved range so that they pass the collision check in
+// MarshalJSON.
+var reservedCodes = map[ErrorCode]bool{
+	E_PARSE:       true,
+	E_INVALID_REQ: true,
+	E_NO_METHOD:   true,
+	E_BAD_PARAMS:  true,
+	E_INTERNAL:    true,
+	E_SERVER:      true,
+}
+
+// isReservedRange reports whether code falls in the range the JSON-RPC 2.0
+// spec reserves for pre-defined errors (-32768 to -32000).
+func isReservedRange(code ErrorCode) bool {
+	return code <= -32000 && code >= -32768
+}
+
+// isServerErrorWindow reports whether code falls in the implementation-
+// defined server error window (-32000 to -32099) that the spec carves out
+// of the reserved range for ad-hoc server errors minted via ServerError.
+func isServerErrorWindow(code ErrorCode) bool {
+	return code <= -32000 && code >= -32099
+}
+
+// ServerError coerces code into the implementation-defined server error
+// window (-32000 to -32099) that the spec reserves for ad-hoc, non
+// pre-defined server errors. Codes already inside the window are returned
+// unchanged; anything else is reported as the generic E_SERVER so callers
+// can't accidentally collide with the rest of the reserved range.
+func ServerError(code ErrorCode) ErrorCode {
+	if isServerErrorWindow(code) {
+		return code
+	}
+	return E_SERVER
+}
+
 type Error struct {
 	// A Number that indicates the error type that occurred.
 	Code ErrorCode `json:"code"` /* required */
@@ -41,8 +80,87 @@ type Error struct {
 
 	// A Primitive or Structured value that contains additional information about the error.
 	Data interface{} `json:"data,omitempty"` /* optional */
+
+	// cause is the original error Wrap was called with, if any. It is never
+	// part of the wire representation, it only backs Unwrap.
+	cause error
 }
 
 func (e *Error) Error() string {
 	return e.Message
 }
+
+// Unwrap returns the error Wrap preserved, if any, so that errors.Is and
+// errors.As keep working through a WithErrorMapper chain.
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Is reports whether target is an *Error carrying the same Code, so
+// callers can write errors.Is(err, json2.NewError(json2.E_NO_METHOD, "", nil)).
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code
+}
+
+// MarshalJSON validates that a user-defined Code does not collide with the
+// JSON-RPC reserved range before encoding. The predefined constants and the
+// whole ServerError window (-32000 to -32099) are allowed through; anything
+// else in -32768..-32000 is rejected.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	if isReservedRange(e.Code) && !reservedCodes[e.Code] && !isServerErrorWindow(e.Code) {
+		return nil, fmt.Errorf("json2: error code %d falls in the JSON-RPC reserved range -32768..-32000 and is not one of the predefined constants or the ServerError window", e.Code)
+	}
+
+	type alias Error
+	return json.Marshal((*alias)(e))
+}
+
+// NewError creates an *Error with the given code, message and optional data.
+func NewError(code ErrorCode, message string, data interface{}) *Error {
+	return &Error{Code: code, Message: message, Data: data}
+}
+
+// NewParseError wraps err as the standard "invalid JSON" parse error,
+// preserving err via Unwrap so errors.Is/errors.As can still reach it.
+func NewParseError(err error) *Error {
+	return &Error{Code: E_PARSE, Message: err.Error(), cause: err}
+}
+
+// NewInvalidRequest reports a request that isn't a valid Request object,
+// attaching data describing what was wrong with it.
+func NewInvalidRequest(data interface{}) *Error {
+	return &Error{Code: E_INVALID_REQ, Message: "invalid request", Data: data}
+}
+
+// NewMethodNotFound reports that method does not exist or is not available.
+func NewMethodNotFound(method string) *Error {
+	return &Error{Code: E_NO_METHOD, Message: fmt.Sprintf("method %q not found", method)}
+}
+
+// NewInvalidParams reports invalid method parameter(s), attaching data
+// describing what was wrong with them.
+func NewInvalidParams(data interface{}) *Error {
+	return &Error{Code: E_BAD_PARAMS, Message: "invalid params", Data: data}
+}
+
+// NewInternalError wraps err as an internal JSON-RPC error.
+func NewInternalError(err error) *Error {
+	return &Error{Code: E_INTERNAL, Message: err.Error(), cause: err}
+}
+
+// Wrap converts any error into an *Error suitable for WriteError, preserving
+// err via Unwrap so errors.As/errors.Is keep working through a
+// WithErrorMapper chain. If err is already an *Error it is returned as-is.
+func Wrap(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if jsonErr, ok := err.(*Error); ok {
+		return jsonErr
+	}
+	return &Error{Code: E_SERVER, Message: err.Error(), cause: err}
+}
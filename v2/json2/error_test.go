@@ -0,0 +1,58 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestErrorMarshalAllowsServerErrorWindow(t *testing.T) {
+	for code := ErrorCode(-32000); code >= -32099; code-- {
+		err := NewError(ServerError(code), "boom", nil)
+		if _, marshalErr := json.Marshal(err); marshalErr != nil {
+			t.Fatalf("code %d: expected ServerError window to marshal cleanly, got %v", code, marshalErr)
+		}
+	}
+}
+
+func TestErrorMarshalRejectsOtherReservedCodes(t *testing.T) {
+	err := NewError(-32100, "boom", nil)
+	if _, marshalErr := json.Marshal(err); marshalErr == nil {
+		t.Fatal("expected marshal to reject a reserved-range code outside the predefined constants and ServerError window")
+	}
+}
+
+func TestErrorMarshalAllowsPredefinedConstants(t *testing.T) {
+	for _, code := range []ErrorCode{E_PARSE, E_INVALID_REQ, E_NO_METHOD, E_BAD_PARAMS, E_INTERNAL, E_SERVER} {
+		err := NewError(code, "boom", nil)
+		if _, marshalErr := json.Marshal(err); marshalErr != nil {
+			t.Fatalf("code %d: expected predefined constant to marshal cleanly, got %v", code, marshalErr)
+		}
+	}
+}
+
+func TestNewParseErrorPreservesCauseForUnwrap(t *testing.T) {
+	cause := errors.New("unexpected end of JSON input")
+	err := NewParseError(cause)
+
+	if !errors.Is(err, cause) {
+		t.Fatal("expected errors.Is(NewParseError(cause), cause) to hold")
+	}
+	if unwrapped := errors.Unwrap(err); unwrapped != cause {
+		t.Fatalf("errors.Unwrap(err) = %v, want %v", unwrapped, cause)
+	}
+}
+
+func TestServerErrorCoercesOutOfWindowCodes(t *testing.T) {
+	if got := ServerError(-42); got != E_SERVER {
+		t.Fatalf("ServerError(-42) = %d, want E_SERVER", got)
+	}
+	if got := ServerError(-32050); got != -32050 {
+		t.Fatalf("ServerError(-32050) = %d, want -32050 (inside the window)", got)
+	}
+}
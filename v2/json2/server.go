@@ -6,6 +6,7 @@
 package json2
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -14,6 +15,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 )
 
 var null = json.RawMessage([]byte("null"))
@@ -23,6 +27,14 @@ type JSONEncoder interface {
 	Encode(v interface{}) error
 }
 
+// JSONDecoder is the decoding counterpart of JSONEncoder: it lets callers
+// plug in an alternate JSON parser (e.g. jsoniter, go-json, sonic) for the
+// places the codec fully unmarshals a value, in particular request params
+// and client responses.
+type JSONDecoder interface {
+	Decode(v interface{}) error
+}
+
 // ----------------------------------------------------------------------------
 // Request and Response
 // ----------------------------------------------------------------------------
@@ -70,8 +82,11 @@ type serverResponse struct {
 type options struct {
 	encoderSelector    rpc.EncoderSelector
 	jsonEncoderFactory func(w io.Writer) JSONEncoder
+	jsonDecoderFactory func(r io.Reader) JSONDecoder
 	errorMapper        func(context.Context, error) error
 	mapAllErrors       bool
+	parallelBatch      int
+	strictParams       bool
 }
 
 type Option interface {
@@ -105,12 +120,35 @@ func WithJSONEncoderFactory(factory func(w io.Writer) JSONEncoder) Option {
 	return optionFunc(func(opts *options) { opts.jsonEncoderFactory = factory })
 }
 
+// WithJSONDecoderFactory defines the JSONDecoder used to unmarshal request
+// params, letting users swap in a faster parser without forking the codec.
+// It does not affect DecodeClientResponse, which always uses encoding/json;
+// client responses take their decoder through DecodeClientResponseWithDecoder.
+func WithJSONDecoderFactory(factory func(r io.Reader) JSONDecoder) Option {
+	return optionFunc(func(opts *options) { opts.jsonDecoderFactory = factory })
+}
+
+// WithParallelBatch bounds the number of batch entries DispatchBatch runs at
+// once to n (unbounded if n <= 0). The batchAggregator behind WriteResponse
+// and WriteError tolerates entries completing in any order regardless of n.
+func WithParallelBatch(n int) Option {
+	return optionFunc(func(opts *options) { opts.parallelBatch = n })
+}
+
+// WithStrictParams rejects by-name params objects that carry a member not
+// resolved by any field of the args type, returning E_BAD_PARAMS instead of
+// silently ignoring the extra data.
+func WithStrictParams() Option {
+	return optionFunc(func(opts *options) { opts.strictParams = true })
+}
+
 // NewCustomCodec returns a new JSON Codec based on passed encoder selector.
 func NewCustomCodec(opts ...Option) *Codec {
 	codec := &Codec{
 		options: options{
 			encoderSelector:    rpc.DefaultEncoderSelector,
 			jsonEncoderFactory: builtInJSONEncoderFactory,
+			jsonDecoderFactory: builtInJSONDecoderFactory,
 		},
 	}
 
@@ -125,6 +163,10 @@ func builtInJSONEncoderFactory(w io.Writer) JSONEncoder {
 	return json.NewEncoder(w)
 }
 
+func builtInJSONDecoderFactory(r io.Reader) JSONDecoder {
+	return json.NewDecoder(r)
+}
+
 // NewCodec returns a new JSON Codec.
 func NewCodec() *Codec {
 	return NewCustomCodec()
@@ -141,8 +183,11 @@ func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 		r,
 		c.encoderSelector.Select(r),
 		c.jsonEncoderFactory,
+		c.jsonDecoderFactory,
 		c.errorMapper,
 		c.mapAllErrors,
+		c.parallelBatch,
+		c.strictParams,
 	)
 }
 
@@ -155,8 +200,11 @@ func newCodecRequest(
 	r *http.Request,
 	encoder rpc.Encoder,
 	jsonEncoderFactory func(w io.Writer) JSONEncoder,
+	jsonDecoderFactory func(r io.Reader) JSONDecoder,
 	errorMapper func(context.Context, error) error,
 	mapAllErrors bool,
+	parallelBatch int,
+	strictParams bool,
 ) rpc.CodecRequest {
 
 	requests, isBatch, err := parseMessage(r)
@@ -185,11 +233,25 @@ func newCodecRequest(
 		err:                err,
 		encoder:            encoder,
 		jsonEncoderFactory: jsonEncoderFactory,
+		jsonDecoderFactory: jsonDecoderFactory,
 		errorMapper:        errorMapper,
 		mapAllErrors:       mapAllErrors,
+		parallelBatch:      parallelBatch,
+		strictParams:       strictParams,
+		paramsStyles:       make([]ParamsStyle, len(requests)),
 	}
 }
 
+// ParamsStyle identifies whether a request's params were passed by-position
+// or by-name, per http://www.jsonrpc.org/specification#parameter_structures.
+type ParamsStyle int
+
+const (
+	ParamsUnknown ParamsStyle = iota
+	ParamsByPosition
+	ParamsByName
+)
+
 // IsBatch returns true when the first non-whitespace characters is '['
 func IsBatch(raw json.RawMessage) bool {
 	return gjson.ParseBytes(raw).IsArray()
@@ -203,21 +265,62 @@ func parseMessage(r *http.Request) ([]*serverRequest, bool, error) {
 	r.Body.Close()
 
 	raw := json.RawMessage(body)
-	if !IsBatch(raw) {
-		msgs := []*serverRequest{{}}
-		if err := json.Unmarshal(raw, &msgs[0]); err != nil {
-			return nil, false, fmt.Errorf("json unmarshal single request error: %v", err)
-		}
-		return msgs, false, nil
+
+	if !gjson.ValidBytes(raw) {
+		// A payload that merely starts with '[' but isn't valid JSON never
+		// made it far enough to be a batch; report it as a single Response,
+		// as the spec requires when the top-level payload can't be parsed.
+		return nil, false, fmt.Errorf("invalid json request body")
+	}
+
+	isBatch := IsBatch(raw)
+	if !isBatch {
+		return []*serverRequest{parseSingleMessage(raw)}, false, nil
 	}
 
-	var msgs []*serverRequest
-	if err := json.Unmarshal(raw, &msgs); err != nil {
-		return nil, false, fmt.Errorf("json unmarshal batch request error: %v", err)
+	items := gjson.ParseBytes(raw).Array()
+	msgs := make([]*serverRequest, 0, len(items))
+	for _, item := range items {
+		msgs = append(msgs, parseSingleMessage(json.RawMessage(item.Raw)))
 	}
 	return msgs, true, nil
 }
 
+// parseSingleMessage extracts jsonrpc, method and id from raw using gjson
+// rather than unmarshaling the whole message with encoding/json. This
+// short-circuits before an unsupported jsonrpc version ever causes the
+// (possibly large) params payload to be copied: Params is kept as a
+// RawMessage copy of the member's raw bytes and is only unmarshaled lazily, when
+// ReadRequest is called with the concrete args type.
+func parseSingleMessage(raw json.RawMessage) *serverRequest {
+	parsed := gjson.ParseBytes(raw)
+	req := &serverRequest{
+		Version: parsed.Get("jsonrpc").String(),
+		Method:  parsed.Get("method").String(),
+	}
+
+	// A literal "id": null member is a notification, same as id being absent
+	// entirely: encoding/json.Unmarshal into a *json.RawMessage sets the
+	// pointer itself to nil for a JSON null, which is the behavior gjson's
+	// idResult.Exists() (true even for an explicit null) doesn't replicate
+	// on its own.
+	if idResult := parsed.Get("id"); idResult.Exists() && idResult.Type != gjson.Null {
+		id := json.RawMessage(idResult.Raw)
+		req.Id = &id
+	}
+
+	if req.Version != Version {
+		return req
+	}
+
+	if paramsResult := parsed.Get("params"); paramsResult.Exists() {
+		params := json.RawMessage(paramsResult.Raw)
+		req.Params = &params
+	}
+
+	return req
+}
+
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
 	requests           []*serverRequest
@@ -225,15 +328,58 @@ type CodecRequest struct {
 	err                error
 	encoder            rpc.Encoder
 	jsonEncoderFactory func(w io.Writer) JSONEncoder
+	jsonDecoderFactory func(r io.Reader) JSONDecoder
 	errorMapper        func(context.Context, error) error
 	mapAllErrors       bool
-	batchResponses     []*serverResponse
+	parallelBatch      int
+	strictParams       bool
+	batch              *batchAggregator
+	batchInit          sync.Once
+	paramsStyles       []ParamsStyle
+}
+
+// ParamsStyle reports how reqIdx's params were structured, once ReadRequest
+// has been called for it; it is ParamsUnknown before that, and stays so
+// when the request has no params or the CodecRequest already holds an error.
+func (c *CodecRequest) ParamsStyle(reqIdx int) ParamsStyle {
+	return c.paramsStyles[reqIdx]
 }
 
 func (c *CodecRequest) RequestCount() int {
 	return len(c.requests)
 }
 
+// DispatchBatch runs call for every index of a batch request, bounding how
+// many run at once to the value configured by WithParallelBatch (unbounded
+// if it wasn't set), and waits for all of them to finish. call is expected
+// to eventually invoke WriteResponse or WriteError for its index; the
+// batchAggregator those write through tolerates them completing in any
+// order or from any goroutine.
+func (c *CodecRequest) DispatchBatch(ctx context.Context, call func(ctx context.Context, reqIdx int)) {
+	n := c.RequestCount()
+
+	var sem chan struct{}
+	if c.parallelBatch > 0 {
+		sem = make(chan struct{}, c.parallelBatch)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		go func(i int) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			call(ctx, i)
+		}(i)
+	}
+	wg.Wait()
+}
+
 // Method returns the RPC method for the current request.
 //
 // The method uses a dotted notation as in "Service.Method".
@@ -259,32 +405,48 @@ func (c *CodecRequest) Method(reqIdx int) (string, error) {
 // case, to the method's expected parameters.
 func (c *CodecRequest) ReadRequest(reqIdx int, args interface{}) error {
 	request := c.requests[reqIdx]
-	if c.err == nil && request.Params != nil {
+	if c.err != nil || request.Params == nil {
 		// Note: if c.request.Params is nil it's not an error, it's an optional member.
-		// JSON params structured object. Unmarshal to the args object.
-		if err := json.Unmarshal(*request.Params, args); err != nil {
-			// Clearly JSON params is not a structured object, let's try to
-			// turn the struct into a slice of its fields and parse again. This is
-			// to handle array params but re-mapped into the struct fields.
-			params, err := structFieldsToFieldsSlice(args)
-			if err != nil {
-				return fmt.Errorf("transforming struct fields to array of fields: %w", err)
-			}
+		return c.err
+	}
+
+	if gjson.ParseBytes(*request.Params).IsObject() {
+		c.paramsStyles[reqIdx] = ParamsByName
+		return c.readByName(request, args)
+	}
+
+	c.paramsStyles[reqIdx] = ParamsByPosition
+	return c.readByPosition(request, args)
+}
+
+// readByPosition decodes a params member that is not a JSON object (in
+// practice an array) into args, falling back through
+// structFieldsToFieldsSlice and single-element array wrapping to tolerate
+// the RPC params being a struct while the wire params is an array. Object
+// params never reach it; ReadRequest hands those to readByName.
+func (c *CodecRequest) readByPosition(request *serverRequest, args interface{}) error {
+	if err := c.decodeParams(request.Params, args); err != nil {
+		// Clearly JSON params is not a structured object, let's try to
+		// turn the struct into a slice of its fields and parse again. This is
+		// to handle array params but re-mapped into the struct fields.
+		params, ferr := structFieldsToFieldsSlice(args)
+		if ferr != nil {
+			return fmt.Errorf("transforming struct fields to array of fields: %w", ferr)
+		}
 
-			if err = json.Unmarshal(*request.Params, &params); err != nil {
-				// Clearly JSON params is not a structured object, and
-				// reducing fields to a single array did not work.
-				// Final fallback and attempt an unmarshal with JSON params as
-				// array value and RPC params is struct. Unmarshal into
-				// array containing the request struct.
-				params := [1]interface{}{args}
-
-				if err = json.Unmarshal(*request.Params, &params); err != nil {
-					c.err = &Error{
-						Code:    E_INVALID_REQ,
-						Message: err.Error(),
-						Data:    request.Params,
-					}
+		if err = c.decodeParams(request.Params, &params); err != nil {
+			// Clearly JSON params is not a structured object, and
+			// reducing fields to a single array did not work.
+			// Final fallback and attempt a decode with JSON params as
+			// array value and RPC params is struct. Decode into
+			// array containing the request struct.
+			arr := [1]interface{}{args}
+
+			if err = c.decodeParams(request.Params, &arr); err != nil {
+				c.err = &Error{
+					Code:    E_INVALID_REQ,
+					Message: err.Error(),
+					Data:    request.Params,
 				}
 			}
 		}
@@ -292,6 +454,234 @@ func (c *CodecRequest) ReadRequest(reqIdx int, args interface{}) error {
 	return c.err
 }
 
+// readByName decodes an object-shaped params member into args, honoring the
+// rpc struct tag (falling back to json, then the field name) to resolve
+// each JSON member, enforcing any "required" fields, and, when
+// WithStrictParams is set, rejecting members that don't map to a field.
+// Wire members are remapped to the name args' own decoder binds to before
+// decoding, so an rpc tag can name a field the struct's json tag doesn't.
+func (c *CodecRequest) readByName(request *serverRequest, args interface{}) error {
+	fields, err := paramFields(args)
+	if err != nil {
+		return fmt.Errorf("resolving by-name params fields: %w", err)
+	}
+
+	decodeParams, err := remapParamNames(*request.Params, fields)
+	if err != nil {
+		c.err = &Error{
+			Code:    E_INVALID_REQ,
+			Message: err.Error(),
+			Data:    request.Params,
+		}
+		return c.err
+	}
+
+	if err := c.decodeParams(&decodeParams, args); err != nil {
+		c.err = &Error{
+			Code:    E_INVALID_REQ,
+			Message: err.Error(),
+			Data:    request.Params,
+		}
+		return c.err
+	}
+
+	parsed := gjson.ParseBytes(*request.Params)
+
+	var missing []string
+	for _, f := range fields {
+		if f.required && !parsed.Get(f.name).Exists() {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) > 0 {
+		c.err = &Error{
+			Code:    E_BAD_PARAMS,
+			Message: "missing required params",
+			Data:    missing,
+		}
+		return c.err
+	}
+
+	if c.strictParams {
+		known := make(map[string]bool, len(fields))
+		for _, f := range fields {
+			known[f.name] = true
+		}
+
+		var unknown []string
+		parsed.ForEach(func(key, _ gjson.Result) bool {
+			if !known[key.String()] {
+				unknown = append(unknown, key.String())
+			}
+			return true
+		})
+		if len(unknown) > 0 {
+			c.err = &Error{
+				Code:    E_BAD_PARAMS,
+				Message: "unknown params",
+				Data:    unknown,
+			}
+			return c.err
+		}
+	}
+
+	return nil
+}
+
+// paramField describes how a single exported field of a by-name args type
+// resolves to a JSON member name.
+type paramField struct {
+	// name is the wire name used for the required/strict-mode checks,
+	// preferring the rpc tag, then the json tag, then the Go field name.
+	name string
+
+	// decodeKey is the member name args' own decoder actually binds this
+	// field from: the json tag (or field name), ignoring rpc entirely. It
+	// only differs from name when a field sets an rpc tag without a
+	// matching json tag.
+	decodeKey string
+
+	required bool
+}
+
+// paramFields resolves the wire name, decoder key and requiredness of each
+// exported field of args' underlying struct. name prefers the rpc tag, then
+// the json tag, then the Go field name; decodeKey is whatever the struct's
+// own json tag (or field name) resolves to, since that's what args'
+// decoder actually matches against.
+func paramFields(args interface{}) ([]paramField, error) {
+	v := reflect.ValueOf(args)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("by-name params require a struct, got %s", v.Kind())
+	}
+
+	return collectParamFields(v.Type()), nil
+}
+
+// collectParamFields walks t's exported fields, recursing into anonymous
+// struct fields the same way encoding/json promotes them (an embedded
+// field with no json/rpc tag of its own contributes its fields directly to
+// the parent rather than as a single nested field), so a shared embedded
+// params type's rpc tags are still seen by the required/strict-mode checks.
+func collectParamFields(t reflect.Type) []paramField {
+	fields := make([]paramField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+
+		_, hasJSONTag := sf.Tag.Lookup("json")
+		_, hasRPCTag := sf.Tag.Lookup("rpc")
+		if sf.Anonymous && !hasJSONTag && !hasRPCTag {
+			ft := sf.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, collectParamFields(ft)...)
+				continue
+			}
+		}
+
+		name := sf.Name
+		decodeKey := sf.Name
+		required := false
+
+		if jsonTag, ok := sf.Tag.Lookup("json"); ok {
+			parts := strings.Split(jsonTag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				decodeKey = parts[0]
+			}
+			name = decodeKey
+			for _, opt := range parts[1:] {
+				if opt == "required" {
+					required = true
+				}
+			}
+		}
+
+		if rpcTag, ok := sf.Tag.Lookup("rpc"); ok {
+			parts := strings.Split(rpcTag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "required" {
+					required = true
+				}
+			}
+		}
+
+		fields = append(fields, paramField{name: name, decodeKey: decodeKey, required: required})
+	}
+
+	return fields
+}
+
+// remapParamNames rewrites raw's top-level object keys from their wire name
+// (f.name) to the name args' own decoder matches against (f.decodeKey), so
+// that a field declared e.g. rpc:"user_id,required" with no matching json
+// tag is actually populated by decodeParams instead of silently staying
+// zero-valued. Keys with no matching field, or whose name and decodeKey
+// already agree, are left untouched.
+func remapParamNames(raw json.RawMessage, fields []paramField) (json.RawMessage, error) {
+	renames := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if f.name != f.decodeKey {
+			renames[f.name] = f.decodeKey
+		}
+	}
+	if len(renames) == 0 {
+		return raw, nil
+	}
+
+	parsed := gjson.ParseBytes(raw)
+	if !parsed.IsObject() {
+		return raw, nil
+	}
+
+	remapped := make(map[string]json.RawMessage, len(renames))
+	var forEachErr error
+	parsed.ForEach(func(key, value gjson.Result) bool {
+		k := key.String()
+		if decodeKey, ok := renames[k]; ok {
+			k = decodeKey
+		}
+		if _, dup := remapped[k]; dup {
+			forEachErr = fmt.Errorf("remapping rpc tag names: %q collides with an existing params member", k)
+			return false
+		}
+		remapped[k] = json.RawMessage(value.Raw)
+		return true
+	})
+	if forEachErr != nil {
+		return nil, forEachErr
+	}
+
+	out, err := json.Marshal(remapped)
+	if err != nil {
+		return nil, fmt.Errorf("remapping rpc tag names: %w", err)
+	}
+	return out, nil
+}
+
+// decodeParams decodes raw into v using the codec's configured JSONDecoder,
+// so that callers providing WithJSONDecoderFactory get the faster parser on
+// the params hot path too, not just encoding/json's default.
+func (c *CodecRequest) decodeParams(raw *json.RawMessage, v interface{}) error {
+	return c.jsonDecoderFactory(bytes.NewReader(*raw)).Decode(v)
+}
+
 // WriteResponse encodes the response and writes it to the ResponseWriter.
 func (c *CodecRequest) WriteResponse(reqIdx int, w http.ResponseWriter, reply interface{}) {
 	res := &serverResponse{
@@ -336,22 +726,28 @@ func (c CodecRequest) tryToMapIfNotAnErrorAlready(ctx context.Context, err error
 }
 
 func (c *CodecRequest) writeServerResponse(reqIdx int, w http.ResponseWriter, res *serverResponse) {
-	var out interface{} = res
+	// Id is null for notifications and they don't have a response, unless we couldn't even parse the JSON, in that
+	// case we can't know whether it was intended to be a notification
+	isNotification := c.requests[reqIdx].Id == nil && !isParseErrorResponse(res)
+
 	if c.isBatch {
-		c.batchResponses = append(c.batchResponses, res)
-		batchCompleted := reqIdx == len(c.requests)-1
-		if !batchCompleted {
-			return
-		}
-		out = c.batchResponses
+		// batchInit guards against a check-then-act race: writeServerResponse
+		// is called concurrently once a caller uses DispatchBatch, and two
+		// goroutines both observing c.batch == nil would each build their own
+		// aggregator around a fresh c.encoder.Encode(w), silently discarding
+		// whichever one loses the race along with its submitted responses.
+		c.batchInit.Do(func() {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			c.batch = newBatchAggregator(c.encoder.Encode(w), len(c.requests), c.jsonEncoderFactory)
+		})
+		c.batch.submit(reqIdx, res, isNotification)
+		return
 	}
 
-	// Id is null for notifications and they don't have a response, unless we couldn't even parse the JSON, in that
-	// case we can't know whether it was intended to be a notification
-	if c.requests[reqIdx].Id != nil || isParseErrorResponse(res) {
+	if !isNotification {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		encoder := c.jsonEncoderFactory(c.encoder.Encode(w))
-		err := encoder.Encode(out)
+		err := encoder.Encode(res)
 
 		// Not sure in which case will this happen. But seems harmless.
 		if err != nil {
@@ -364,12 +760,115 @@ func isParseErrorResponse(res *serverResponse) bool {
 	return res != nil && res.Error != nil && res.Error.Code == E_PARSE
 }
 
+// batchAggregator collects the responses of a JSON-RPC batch and streams
+// them to w as a single JSON array via the pluggable JSONEncoder, without
+// requiring that entries arrive in index order or buffering the whole
+// batch as an []interface{} before encoding. A bitmap tracks which indices
+// have already been submitted so a batch processed by several concurrent
+// workers (see WithParallelBatch) can't double-write an entry, and entries
+// whose request was a notification are silently dropped, per the spec.
+type batchAggregator struct {
+	mu      sync.Mutex
+	w       io.Writer
+	encoder func(w io.Writer) JSONEncoder
+
+	count   int
+	written []uint64
+	buffer  map[int]*serverResponse
+	next    int
+	opened  bool
+	closed  bool
+}
+
+func newBatchAggregator(w io.Writer, count int, encoder func(w io.Writer) JSONEncoder) *batchAggregator {
+	return &batchAggregator{
+		w:       w,
+		encoder: encoder,
+		count:   count,
+		written: make([]uint64, (count+63)/64),
+		buffer:  make(map[int]*serverResponse, count),
+	}
+}
+
+// submit records the response for idx, replacing it with nil when
+// isNotification is true, then flushes any run of entries starting at the
+// next expected index that is now contiguous.
+func (b *batchAggregator) submit(idx int, res *serverResponse, isNotification bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.markWritten(idx) {
+		return // already submitted for this index, ignore
+	}
+
+	if isNotification {
+		res = nil
+	}
+	b.buffer[idx] = res
+
+	for {
+		next, ok := b.buffer[b.next]
+		if !ok {
+			break
+		}
+		delete(b.buffer, b.next)
+		b.writeEntry(next)
+		b.next++
+	}
+
+	if b.next == b.count {
+		b.close()
+	}
+}
+
+func (b *batchAggregator) markWritten(idx int) (alreadyWritten bool) {
+	word, bit := idx/64, uint(idx%64)
+	alreadyWritten = b.written[word]&(1<<bit) != 0
+	b.written[word] |= 1 << bit
+	return alreadyWritten
+}
+
+func (b *batchAggregator) writeEntry(res *serverResponse) {
+	if res == nil {
+		// Notification: omitted from the array per JSON-RPC 2.0.
+		return
+	}
+
+	if !b.opened {
+		io.WriteString(b.w, "[")
+		b.opened = true
+	} else {
+		io.WriteString(b.w, ",")
+	}
+	b.encoder(b.w).Encode(res)
+}
+
+func (b *batchAggregator) close() {
+	if b.closed {
+		return
+	}
+	b.closed = true
+	if !b.opened {
+		// The batch was entirely notifications: per spec the server must
+		// not return an empty array, it must return nothing at all.
+		return
+	}
+	io.WriteString(b.w, "]")
+}
+
 type EmptyResponse struct {
 }
 
 // DecodeClientResponse decodes the response body of a client request into
-// the interface reply.
+// one clientResponse per entry, using the built-in encoding/json decoder.
 func DecodeClientResponse(r io.Reader) ([]*clientResponse, error) {
+	return DecodeClientResponseWithDecoder(r, builtInJSONDecoderFactory)
+}
+
+// DecodeClientResponseWithDecoder behaves like DecodeClientResponse but lets
+// callers plug in an alternate JSONDecoder, mirroring WithJSONDecoderFactory
+// on the server side.
+func DecodeClientResponseWithDecoder(r io.Reader, decoderFactory func(io.Reader) JSONDecoder) ([]*clientResponse, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, fmt.Errorf("reading response body: %w", err)
@@ -377,8 +876,7 @@ func DecodeClientResponse(r io.Reader) ([]*clientResponse, error) {
 	raw := json.RawMessage(data)
 	c := &clientResponse{}
 	if !IsBatch(raw) {
-		err = json.Unmarshal(data, &c)
-		if err != nil {
+		if err := decoderFactory(bytes.NewReader(data)).Decode(c); err != nil {
 			return nil, fmt.Errorf("decoding none batch response body: %w", err)
 		}
 
@@ -386,8 +884,7 @@ func DecodeClientResponse(r io.Reader) ([]*clientResponse, error) {
 	}
 
 	var cr []*clientResponse
-	err = json.Unmarshal(data, &cr)
-	if err != nil {
+	if err := decoderFactory(bytes.NewReader(data)).Decode(&cr); err != nil {
 		return nil, fmt.Errorf("decoding batch response body: %w", err)
 	}
 
@@ -0,0 +1,260 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func rawID(n int) *json.RawMessage {
+	raw := json.RawMessage(strconv.Itoa(n))
+	return &raw
+}
+
+func TestBatchAggregatorOutOfOrderSubmit(t *testing.T) {
+	var buf bytes.Buffer
+	agg := newBatchAggregator(&buf, 5, builtInJSONEncoderFactory)
+
+	order := []int{4, 2, 0, 3, 1}
+	var wg sync.WaitGroup
+	for _, idx := range order {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			agg.submit(idx, &serverResponse{Version: Version, Result: idx, Id: rawID(idx)}, false)
+		}(idx)
+	}
+	wg.Wait()
+
+	var got []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not a valid JSON array: %v\n%s", err, buf.String())
+	}
+	if len(got) != 5 {
+		t.Fatalf("got %d entries, want 5", len(got))
+	}
+	for i, entry := range got {
+		if int(entry["result"].(float64)) != i {
+			t.Fatalf("entry %d out of order: %v", i, entry)
+		}
+	}
+}
+
+func TestBatchAggregatorOmitsNotifications(t *testing.T) {
+	var buf bytes.Buffer
+	agg := newBatchAggregator(&buf, 3, builtInJSONEncoderFactory)
+
+	agg.submit(0, &serverResponse{Version: Version, Result: 0, Id: rawID(0)}, false)
+	agg.submit(1, &serverResponse{Version: Version, Result: 1, Id: rawID(1)}, true) // notification
+	agg.submit(2, &serverResponse{Version: Version, Result: 2, Id: rawID(2)}, false)
+
+	var got []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not a valid JSON array: %v\n%s", err, buf.String())
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d entries, want 2 (notification should be omitted)", len(got))
+	}
+}
+
+func TestBatchAggregatorAllNotificationsWriteNothing(t *testing.T) {
+	var buf bytes.Buffer
+	agg := newBatchAggregator(&buf, 2, builtInJSONEncoderFactory)
+
+	agg.submit(0, &serverResponse{Version: Version}, true)
+	agg.submit(1, &serverResponse{Version: Version}, true)
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing written for an all-notification batch, got %q", buf.String())
+	}
+}
+
+func TestCodecRequestDispatchBatchBoundsConcurrency(t *testing.T) {
+	cr := &CodecRequest{parallelBatch: 2, requests: make([]*serverRequest, 6)}
+
+	var active, maxActive int32
+	cr.DispatchBatch(context.Background(), func(ctx context.Context, reqIdx int) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			old := atomic.LoadInt32(&maxActive)
+			if n <= old || atomic.CompareAndSwapInt32(&maxActive, old, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	})
+
+	if maxActive > 2 {
+		t.Fatalf("observed %d concurrent dispatches, want <= 2 (WithParallelBatch(2))", maxActive)
+	}
+}
+
+func TestParseMessageNullIdIsTreatedAsNotification(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		body      string
+		wantNilID bool
+	}{
+		{"missing id", `{"jsonrpc":"2.0","method":"ping"}`, true},
+		{"null id", `{"jsonrpc":"2.0","method":"ping","id":null}`, true},
+		{"string id", `{"jsonrpc":"2.0","method":"ping","id":"abc"}`, false},
+		{"number id", `{"jsonrpc":"2.0","method":"ping","id":1}`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			msgs, _, err := parseMessage(r)
+			if err != nil {
+				t.Fatalf("parseMessage: %v", err)
+			}
+			if gotNil := msgs[0].Id == nil; gotNil != tc.wantNilID {
+				t.Fatalf("Id == nil is %v, want %v", gotNil, tc.wantNilID)
+			}
+		})
+	}
+}
+
+func newByNameCodecRequest(params string) *CodecRequest {
+	raw := json.RawMessage(params)
+	return &CodecRequest{
+		requests:           []*serverRequest{{Version: Version, Method: "m", Params: &raw, Id: rawID(0)}},
+		jsonDecoderFactory: builtInJSONDecoderFactory,
+		paramsStyles:       make([]ParamsStyle, 1),
+	}
+}
+
+func TestReadByNameBindsRPCTagWithoutMatchingJSONTag(t *testing.T) {
+	var args struct {
+		UserID string `rpc:"user_id,required"`
+	}
+
+	cr := newByNameCodecRequest(`{"user_id":"abc123"}`)
+	if err := cr.ReadRequest(0, &args); err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if args.UserID != "abc123" {
+		t.Fatalf("UserID = %q, want %q (rpc tag name should bind even without a matching json tag)", args.UserID, "abc123")
+	}
+}
+
+func TestReadByNameRPCRequiredStillEnforced(t *testing.T) {
+	var args struct {
+		UserID string `rpc:"user_id,required"`
+	}
+
+	cr := newByNameCodecRequest(`{}`)
+	err := cr.ReadRequest(0, &args)
+	if err == nil {
+		t.Fatal("expected missing required rpc-tagged field to be reported")
+	}
+	rpcErr, ok := err.(*Error)
+	if !ok || rpcErr.Code != E_BAD_PARAMS {
+		t.Fatalf("err = %v, want an *Error with code E_BAD_PARAMS", err)
+	}
+}
+
+func TestReadByNameStrictParamsAcceptsRPCTagName(t *testing.T) {
+	var args struct {
+		UserID string `rpc:"user_id"`
+	}
+
+	cr := newByNameCodecRequest(`{"user_id":"abc123"}`)
+	cr.strictParams = true
+	if err := cr.ReadRequest(0, &args); err != nil {
+		t.Fatalf("ReadRequest: %v, want WithStrictParams to accept a member matching the rpc tag name", err)
+	}
+}
+
+func TestReadByNamePromotesAnonymousEmbeddedFields(t *testing.T) {
+	type BaseParams struct {
+		RequestID string `rpc:"request_id,required"`
+	}
+	var args struct {
+		BaseParams
+		UserID string `rpc:"user_id"`
+	}
+
+	cr := newByNameCodecRequest(`{"request_id":"req-1","user_id":"abc123"}`)
+	cr.strictParams = true
+	if err := cr.ReadRequest(0, &args); err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if args.RequestID != "req-1" || args.UserID != "abc123" {
+		t.Fatalf("args = %+v, want promoted embedded field populated alongside the outer one", args)
+	}
+}
+
+func TestReadByNameEnforcesRequiredOnEmbeddedField(t *testing.T) {
+	type BaseParams struct {
+		RequestID string `rpc:"request_id,required"`
+	}
+	var args struct {
+		BaseParams
+		UserID string `rpc:"user_id"`
+	}
+
+	cr := newByNameCodecRequest(`{"user_id":"abc123"}`)
+	err := cr.ReadRequest(0, &args)
+	if err == nil {
+		t.Fatal("expected missing required embedded field to be reported")
+	}
+	rpcErr, ok := err.(*Error)
+	if !ok || rpcErr.Code != E_BAD_PARAMS {
+		t.Fatalf("err = %v, want an *Error with code E_BAD_PARAMS", err)
+	}
+}
+
+func TestReadByNameStrictParamsRejectsUnknownMember(t *testing.T) {
+	var args struct {
+		UserID string `rpc:"user_id"`
+	}
+
+	cr := newByNameCodecRequest(`{"user_id":"abc123","extra":true}`)
+	cr.strictParams = true
+	err := cr.ReadRequest(0, &args)
+	if err == nil {
+		t.Fatal("expected unknown member to be rejected under WithStrictParams")
+	}
+	rpcErr, ok := err.(*Error)
+	if !ok || rpcErr.Code != E_BAD_PARAMS {
+		t.Fatalf("err = %v, want an *Error with code E_BAD_PARAMS", err)
+	}
+}
+
+func TestParseMessageMalformedBatchLookingBodyIsNotReportedAsBatch(t *testing.T) {
+	body := `[{"jsonrpc":"2.0","method":"ping"` // looks like a batch, truncated mid-object
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	_, isBatch, err := parseMessage(r)
+	if err == nil {
+		t.Fatal("expected parseMessage to reject invalid JSON")
+	}
+	if isBatch {
+		t.Fatal("isBatch = true for invalid JSON, want false so the error is reported as a single Response")
+	}
+}
+
+func TestCodecRequestDispatchBatchRunsEveryEntry(t *testing.T) {
+	cr := &CodecRequest{requests: make([]*serverRequest, 9)}
+
+	var count int32
+	cr.DispatchBatch(context.Background(), func(ctx context.Context, reqIdx int) {
+		atomic.AddInt32(&count, 1)
+	})
+
+	if count != 9 {
+		t.Fatalf("DispatchBatch invoked call %d times, want 9", count)
+	}
+}